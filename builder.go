@@ -2,9 +2,13 @@ package graphql
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -12,21 +16,37 @@ var (
 	// reference: https://spec.graphql.org/June2018/#sec-Names
 	regexVariableName = regexp.MustCompile(`\$([_A-Za-z][_0-9A-Za-z]*)`)
 
+	// regular expression for a Spread() placeholder left inside a query string
+	regexSpreadMarker = regexp.MustCompile(`@@spread:([_A-Za-z][_0-9A-Za-z]*)@@`)
+
 	errBuildQueryRequired = errors.New("no graphql query to be built")
 )
 
 type queryBuilderItem struct {
 	query        string
+	alias        string
 	binding      interface{}
 	requiredVars []string
+	includeIf    string
+	isFragment   bool
+}
+
+// defaultSpec holds the declared type and fallback value of a variable
+// registered through Builder.VariableWithDefault
+type defaultSpec struct {
+	typeSig string
+	value   interface{}
 }
 
 // Builder is used to efficiently build dynamic queries and variables
 // It helps construct multiple queries to a single request that needs to be conditionally added
 type Builder struct {
-	context   context.Context
-	queries   []queryBuilderItem
-	variables map[string]interface{}
+	context       context.Context
+	queries       []queryBuilderItem
+	variables     map[string]interface{}
+	defaults      map[string]defaultSpec
+	operationName string
+	persisted     bool
 }
 
 // QueryBinding the type alias of interface tuple
@@ -37,15 +57,19 @@ type QueryBinding [2]interface{}
 func NewBuilder() Builder {
 	return Builder{
 		variables: make(map[string]interface{}),
+		defaults:  make(map[string]defaultSpec),
 	}
 }
 
 // Bind returns the new Builder with the inputted query
 func (b Builder) Context(ctx context.Context) Builder {
 	return Builder{
-		context:   ctx,
-		queries:   b.queries,
-		variables: b.variables,
+		context:       ctx,
+		queries:       b.queries,
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
@@ -54,29 +78,192 @@ func (b Builder) Bind(query string, binding interface{}) Builder {
 	return Builder{
 		context: b.context,
 		queries: append(b.queries, queryBuilderItem{
-			query,
-			binding,
-			findAllVariableNames(query),
+			query:        query,
+			binding:      binding,
+			requiredVars: findAllVariableNames(query),
+		}),
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// BindAlias returns the new Builder with a new query bound under an alias.
+// Use this to compose multiple calls to the same root field in a single
+// request, e.g. BindAlias("a", "user(id: $a)", &a).BindAlias("b", "user(id: $b)", &b)
+// renders as `a: user(id: $a) { ... } b: user(id: $b) { ... }` and each
+// binding is decoded from its aliased key in the response.
+func (b Builder) BindAlias(alias string, query string, binding interface{}) Builder {
+	return Builder{
+		context: b.context,
+		queries: append(b.queries, queryBuilderItem{
+			query:        query,
+			alias:        alias,
+			binding:      binding,
+			requiredVars: findAllVariableNames(query),
+		}),
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// BindIf returns the new Builder with a query that is only resolved by the
+// server when condVar is true, emitted as `query @include(if: $condVar) { ... }`.
+// The $condVar: Boolean! variable requirement is injected automatically, and
+// the binding is left untouched by decoding when the field is absent from the
+// response. This lets a single prepared builder cover several optional
+// branches without being rebuilt per permission tier; the same condVar may be
+// reused across multiple BindIf calls.
+func (b Builder) BindIf(condVar string, query string, binding interface{}) Builder {
+	return Builder{
+		context: b.context,
+		queries: append(b.queries, queryBuilderItem{
+			query:        query,
+			binding:      binding,
+			requiredVars: append(findAllVariableNames(query), condVar),
+			includeIf:    condVar,
 		}),
-		variables: b.variables,
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// Fragment returns the new Builder with a named fragment definition bound to
+// onType. Spread the fragment into other Bind/BindAlias/BindIf query strings
+// with Spread(name) to reuse the same selection set instead of copy-pasting
+// field lists across calls.
+func (b Builder) Fragment(name string, onType string, binding interface{}) Builder {
+	return Builder{
+		context: b.context,
+		queries: append(b.queries, queryBuilderItem{
+			query:      fmt.Sprintf("fragment %s on %s", name, onType),
+			binding:    binding,
+			isFragment: true,
+		}),
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// Spread returns a placeholder marker for embedding inside a query string
+// passed to Bind/BindAlias/BindIf; Build rewrites it into a `...name`
+// fragment spread once the operation text is composed
+func Spread(name string) string {
+	return "@@spread:" + name + "@@"
+}
+
+// UnbindAlias returns the new Builder with the aliased query item and its
+// related variables removed
+func (b Builder) UnbindAlias(alias string, extra ...string) Builder {
+	var newQueries []queryBuilderItem
+	newVars := make(map[string]interface{})
+
+	for _, q := range b.queries {
+		if q.alias == alias || sliceStringContains(extra, q.alias) {
+			continue
+		}
+		newQueries = append(newQueries, q)
+		if len(b.variables) > 0 {
+			for _, k := range q.requiredVars {
+				if v, ok := b.variables[k]; ok {
+					newVars[k] = v
+				}
+			}
+		}
+	}
+
+	return Builder{
+		context:       b.context,
+		queries:       newQueries,
+		variables:     newVars,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
 // Variables returns the new Builder with the inputted variables
 func (b Builder) Variable(key string, value interface{}) Builder {
 	return Builder{
-		context:   b.context,
-		queries:   b.queries,
-		variables: setMapValue(b.variables, key, value),
+		context:       b.context,
+		queries:       b.queries,
+		variables:     setMapValue(b.variables, key, value),
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
 // Variables returns the new Builder with the inputted variables
 func (b Builder) Variables(variables map[string]interface{}) Builder {
 	return Builder{
-		context:   b.context,
-		queries:   b.queries,
-		variables: mergeMap(b.variables, variables),
+		context:       b.context,
+		queries:       b.queries,
+		variables:     mergeMap(b.variables, variables),
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// VariableWithDefault returns the new Builder with a variable default registered.
+// When Build runs, a required variable missing from the builder's variables is
+// auto-populated from its default instead of failing the mismatched-variables
+// check. Use VariableDefinitions to render the `$name: typeSig = defaultValue`
+// fragments for the generated operation signature so the server sees the
+// fallback too.
+func (b Builder) VariableWithDefault(name string, typeSig string, defaultValue interface{}) Builder {
+	newDefaults := make(map[string]defaultSpec, len(b.defaults)+1)
+	for k, v := range b.defaults {
+		newDefaults[k] = v
+	}
+	newDefaults[name] = defaultSpec{typeSig: typeSig, value: defaultValue}
+
+	return Builder{
+		context:       b.context,
+		queries:       b.queries,
+		variables:     b.variables,
+		defaults:      newDefaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
+	}
+}
+
+// VariableDefinitions returns the `$name: typeSig = defaultLiteral` operation
+// signature fragments for every variable registered through
+// VariableWithDefault, sorted by name for a deterministic signature
+func (b Builder) VariableDefinitions() []string {
+	names := make([]string, 0, len(b.defaults))
+	for name := range b.defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]string, 0, len(names))
+	for _, name := range names {
+		spec := b.defaults[name]
+		defs = append(defs, fmt.Sprintf("$%s: %s = %s", name, spec.typeSig, formatDefaultLiteral(spec.value)))
+	}
+	return defs
+}
+
+// formatDefaultLiteral renders a Go value as a GraphQL literal for use in a
+// `$name: Type = literal` variable definition
+func formatDefaultLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprintf("%v", v)
 	}
 }
 
@@ -100,9 +287,12 @@ func (b Builder) Unbind(query string, extra ...string) Builder {
 	}
 
 	return Builder{
-		context:   b.context,
-		queries:   newQueries,
-		variables: newVars,
+		context:       b.context,
+		queries:       newQueries,
+		variables:     newVars,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
@@ -119,9 +309,12 @@ func (b Builder) RemoveQuery(query string, extra ...string) Builder {
 	}
 
 	return Builder{
-		context:   b.context,
-		queries:   newQueries,
-		variables: b.variables,
+		context:       b.context,
+		queries:       newQueries,
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
@@ -135,9 +328,12 @@ func (b Builder) RemoveVariable(key string, extra ...string) Builder {
 	}
 
 	return Builder{
-		context:   b.context,
-		queries:   b.queries,
-		variables: newVars,
+		context:       b.context,
+		queries:       b.queries,
+		variables:     newVars,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     b.persisted,
 	}
 }
 
@@ -151,12 +347,33 @@ func (b Builder) Build() ([]QueryBinding, map[string]interface{}, error) {
 	for _, q := range b.queries {
 		requiredVars = append(requiredVars, q.requiredVars...)
 	}
-	variableLength := len(b.variables)
-	requiredVariableLength := len(requiredVars)
+
+	seenRequiredVars := make(map[string]bool, len(requiredVars))
+	uniqueRequiredVars := make([]string, 0, len(requiredVars))
+	for _, varName := range requiredVars {
+		if seenRequiredVars[varName] {
+			continue
+		}
+		seenRequiredVars[varName] = true
+		uniqueRequiredVars = append(uniqueRequiredVars, varName)
+	}
+
+	variables := b.variables
+	for _, varName := range uniqueRequiredVars {
+		if _, ok := variables[varName]; ok {
+			continue
+		}
+		if spec, ok := b.defaults[varName]; ok {
+			variables = setMapValue(mergeMap(variables, nil), varName, spec.value)
+		}
+	}
+
+	variableLength := len(variables)
+	requiredVariableLength := len(uniqueRequiredVars)
 	isMismatchedVariables := variableLength != requiredVariableLength
 	if !isMismatchedVariables && requiredVariableLength > 0 {
-		for _, varName := range requiredVars {
-			if _, ok := b.variables[varName]; !ok {
+		for _, varName := range uniqueRequiredVars {
+			if _, ok := variables[varName]; !ok {
 				isMismatchedVariables = true
 				break
 			}
@@ -164,17 +381,73 @@ func (b Builder) Build() ([]QueryBinding, map[string]interface{}, error) {
 	}
 	if isMismatchedVariables {
 		varNames := make([]string, 0, variableLength)
-		for k := range b.variables {
+		for k := range variables {
 			varNames = append(varNames, k)
 		}
-		return nil, nil, fmt.Errorf("mismatched variables; want: %+v; got: %+v", requiredVars, varNames)
+		return nil, nil, fmt.Errorf("mismatched variables; want: %+v; got: %+v", uniqueRequiredVars, varNames)
 	}
 
 	query := make([]QueryBinding, 0, len(b.queries))
+	var fragments []QueryBinding
 	for _, q := range b.queries {
-		query = append(query, [2]interface{}{q.query, q.binding})
+		queryText := regexSpreadMarker.ReplaceAllString(q.query, "...$1")
+		if q.includeIf != "" {
+			queryText = queryText + " @include(if: $" + q.includeIf + ")"
+		}
+		if q.alias != "" {
+			queryText = q.alias + ": " + queryText
+		}
+		item := QueryBinding{queryText, q.binding}
+		if q.isFragment {
+			fragments = append(fragments, item)
+			continue
+		}
+		query = append(query, item)
 	}
-	return query, b.variables, nil
+	// fragment definitions are emitted after the operation body so spreads
+	// resolve against a document that reads top-to-bottom
+	query = append(query, fragments...)
+	return query, variables, nil
+}
+
+// DecodeResponse unmarshals the top-level "data" object of a GraphQL
+// response into each bound query's target: a query bound via BindAlias is
+// looked up by its alias, everything else by its root field name parsed out
+// of the query string
+func (b Builder) DecodeResponse(data map[string]json.RawMessage) error {
+	for _, q := range b.queries {
+		if q.isFragment {
+			continue
+		}
+		key := q.alias
+		if key == "" {
+			key = rootFieldName(q.query)
+		}
+		raw, ok := data[key]
+		if !ok {
+			if q.includeIf != "" {
+				// server omits the field entirely when @include(if: $condVar)
+				// evaluated false; leave the binding untouched
+				continue
+			}
+			return fmt.Errorf("missing field %q in response", key)
+		}
+		if err := json.Unmarshal(raw, q.binding); err != nil {
+			return fmt.Errorf("decoding field %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// rootFieldName extracts the root selection name from a query string,
+// stripping any argument list or selection set, e.g. "user(id: $id)" and
+// "user { id }" both yield "user"
+func rootFieldName(query string) string {
+	name := query
+	if idx := strings.IndexAny(name, "( {"); idx >= 0 {
+		name = name[:idx]
+	}
+	return strings.TrimSpace(name)
 }
 
 // Query builds parameters and executes the GraphQL query request
@@ -187,6 +460,9 @@ func (b Builder) Query(c *Client, options ...Option) error {
 	if ctx == nil {
 		ctx = context.TODO()
 	}
+	if b.persisted {
+		options = append(options, b.persistedQueryOption(q, options))
+	}
 	return c.Query(ctx, &q, v, options...)
 }
 
@@ -200,9 +476,109 @@ func (b Builder) Mutate(c *Client, options ...Option) error {
 	if ctx == nil {
 		ctx = context.TODO()
 	}
+	if b.persisted {
+		options = append(options, b.persistedQueryOption(q, options))
+	}
 	return c.Mutate(ctx, &q, v, options...)
 }
 
+// OperationName returns the new Builder with the operation name that
+// Subscribe sends with the subscription request, so subscription servers that
+// key session state by operation name can identify it; Query and Mutate do
+// not send it
+func (b Builder) OperationName(name string) Builder {
+	return Builder{
+		context:       b.context,
+		queries:       b.queries,
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: name,
+		persisted:     b.persisted,
+	}
+}
+
+// Persisted returns the new Builder flagged to use the Apollo Automatic
+// Persisted Queries protocol: the SHA-256 hash of the composed operation is
+// attached to every request. The full query text is attached alongside it on
+// the first request for that hash in the PersistedQueryStore configured via
+// EnablePersistedQueries, and on every request when no store is configured;
+// once the store has recorded the hash, only the hash is attached. The first
+// request for a hash is never sent hash-only.
+func (b Builder) Persisted() Builder {
+	return Builder{
+		context:       b.context,
+		queries:       b.queries,
+		variables:     b.variables,
+		defaults:      b.defaults,
+		operationName: b.operationName,
+		persisted:     true,
+	}
+}
+
+// Subscribe builds parameters and registers the composed multi-root
+// selection as a single subscription against the SubscriptionClient
+func (b Builder) Subscribe(c *SubscriptionClient, handler func(message []byte, err error) error, options ...Option) (string, error) {
+	q, v, err := b.Build()
+	if err != nil {
+		return "", err
+	}
+	return c.Subscribe(&q, v, handler, b.subscribeOptions(q, options...)...)
+}
+
+// subscribeOptions applies OperationName/Persisted on top of the
+// caller-supplied options; factored out of Subscribe so the wiring can be
+// exercised without a live SubscriptionClient
+func (b Builder) subscribeOptions(q []QueryBinding, options ...Option) []Option {
+	if b.operationName != "" {
+		options = append(options, withOperationName(b.operationName))
+	}
+	if b.persisted {
+		options = append(options, b.persistedQueryOption(q, options))
+	}
+	return options
+}
+
+// persistedQueryOption computes the Automatic Persisted Queries hash for the
+// composed operation - the variable signature from VariableDefinitions
+// followed by the field selections - and consults the PersistedQueryStore
+// configured via EnablePersistedQueries among options, if any, to decide
+// whether the full query text needs to be sent alongside the hash
+func (b Builder) persistedQueryOption(q []QueryBinding, options []Option) Option {
+	composed := b.composeQueryText(q)
+	hash := hashQuery(composed)
+
+	var probe requestOptions
+	for _, o := range options {
+		o(&probe)
+	}
+	return resolvePersistedQuery(probe.persistedQueryStore, hash, composed)
+}
+
+// composeQueryText renders the full operation text used for the Automatic
+// Persisted Queries hash: the variable signature from VariableDefinitions
+// (if any), followed by the composed field selections
+func (b Builder) composeQueryText(items []QueryBinding) string {
+	var sb strings.Builder
+	if defs := b.VariableDefinitions(); len(defs) > 0 {
+		sb.WriteString("(")
+		sb.WriteString(strings.Join(defs, ", "))
+		sb.WriteString(")")
+	}
+	for _, item := range items {
+		sb.WriteString(item[0].(string))
+	}
+	return sb.String()
+}
+
+// withOperationName sets the operation name on a single request so
+// subscription servers that key session state by operation name can
+// identify it
+func withOperationName(name string) Option {
+	return func(r *requestOptions) {
+		r.operationName = name
+	}
+}
+
 func setMapValue(src map[string]interface{}, key string, value interface{}) map[string]interface{} {
 	if src == nil {
 		src = make(map[string]interface{})
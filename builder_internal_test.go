@@ -0,0 +1,320 @@
+package graphql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// reproduces a shared condition variable across two BindIf branches, which
+// previously failed Build's mismatch check because requiredVars counted
+// "showDetails" twice while the variables map only ever holds it once
+func TestBuilder_BindIf_SharedCondVar(t *testing.T) {
+	var profile, settings struct {
+		ID string
+	}
+
+	_, vars, err := NewBuilder().
+		BindIf("showDetails", "profile(id: $id)", &profile).
+		BindIf("showDetails", "settings(id: $id2)", &settings).
+		Variable("id", 1).
+		Variable("id2", 2).
+		Variable("showDetails", true).
+		Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if vars["showDetails"] != true {
+		t.Errorf("got showDetails: %+v, want true", vars["showDetails"])
+	}
+}
+
+func TestBuilder_BindAlias(t *testing.T) {
+	var a, b struct {
+		ID string
+	}
+
+	q, vars, err := NewBuilder().
+		BindAlias("a", "user(id: $aID)", &a).
+		BindAlias("b", "user(id: $bID)", &b).
+		Variable("aID", 1).
+		Variable("bID", 2).
+		Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if len(q) != 2 || q[0][0] != "a: user(id: $aID)" || q[1][0] != "b: user(id: $bID)" {
+		t.Errorf("got: %+v, want aliased query text for both items", q)
+	}
+	if vars["aID"] != 1 || vars["bID"] != 2 {
+		t.Errorf("got: %+v, want aID=1 bID=2", vars)
+	}
+}
+
+func TestBuilder_FragmentSpread(t *testing.T) {
+	var user, fields struct {
+		ID string
+	}
+
+	q, _, err := NewBuilder().
+		Bind("user(id: $id)"+Spread("userFields"), &user).
+		Fragment("userFields", "User", &fields).
+		Variable("id", 1).
+		Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if len(q) != 2 {
+		t.Fatalf("got: %+v, want 2 items (query + fragment)", q)
+	}
+	if q[0][0] != "user(id: $id)...userFields" {
+		t.Errorf("got: %q, want spread marker rewritten to ...userFields", q[0][0])
+	}
+	if q[1][0] != "fragment userFields on User" {
+		t.Errorf("got: %q, want fragment definition emitted last", q[1][0])
+	}
+}
+
+func TestBuilder_BindIf_MismatchStillDetected(t *testing.T) {
+	var profile struct {
+		ID string
+	}
+
+	_, _, err := NewBuilder().
+		BindIf("showDetails", "profile(id: $id)", &profile).
+		Variable("id", 1).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "mismatched variables;") {
+		t.Errorf("got: %v, want mismatched variables error", err)
+	}
+}
+
+// VariableDefinitions renders the $name: Type = literal signature fragments
+// that a server needs to see the declared defaults; typeSig used to be
+// captured on VariableWithDefault and never read again
+func TestBuilder_VariableDefinitions(t *testing.T) {
+	var widget struct {
+		ID string
+	}
+
+	b := NewBuilder().
+		Bind("widget(id: $id, color: $color)", &widget).
+		VariableWithDefault("color", "String", "blue").
+		Variable("id", 1)
+
+	_, vars, err := b.Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if vars["color"] != "blue" {
+		t.Errorf("got color: %+v, want %q", vars["color"], "blue")
+	}
+
+	defs := b.VariableDefinitions()
+	want := []string{`$color: String = "blue"`}
+	if len(defs) != len(want) || defs[0] != want[0] {
+		t.Errorf("got: %+v, want: %+v", defs, want)
+	}
+}
+
+// subscribeOptions is the exact option-building step Subscribe delegates to
+// before calling the SubscriptionClient (which this trimmed package doesn't
+// define, so the call itself can't be exercised); operationName/persisted
+// used to be threaded through every constructor and never reach a request
+func TestBuilder_Subscribe_OperationNameAndPersistedOptions(t *testing.T) {
+	var widget struct {
+		ID string
+	}
+	b := NewBuilder().
+		Bind("widget(id: $id)", &widget).
+		Variable("id", 1).
+		OperationName("WatchWidget").
+		Persisted()
+	q, _, err := b.Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+
+	var r requestOptions
+	for _, opt := range b.subscribeOptions(q) {
+		opt(&r)
+	}
+
+	if r.operationName != "WatchWidget" {
+		t.Errorf("got request operationName: %q, want %q", r.operationName, "WatchWidget")
+	}
+	if r.persistedQueryHash == "" {
+		t.Errorf("got empty persistedQueryHash, want the APQ hash of the composed query")
+	}
+}
+
+type fakePersistedQueryStore struct {
+	entries  map[string]string
+	getCalls int
+	setCalls int
+}
+
+func (s *fakePersistedQueryStore) Get(hash string) (string, bool) {
+	s.getCalls++
+	q, ok := s.entries[hash]
+	return q, ok
+}
+
+func (s *fakePersistedQueryStore) Set(hash string, query string) {
+	s.setCalls++
+	if s.entries == nil {
+		s.entries = make(map[string]string)
+	}
+	s.entries[hash] = query
+}
+
+// hashQuery used to be defined but never called, and composeQueryText never
+// folded VariableDefinitions into the hashed text; Query/Mutate/Subscribe
+// now compute the hash from the full composed operation (signature + body)
+func TestBuilder_ComposeQueryTextAndHash(t *testing.T) {
+	var widget struct {
+		ID string
+	}
+
+	b := NewBuilder().
+		Bind("widget(id: $id, color: $color)", &widget).
+		VariableWithDefault("color", "String", "blue").
+		Variable("id", 1)
+	q, _, err := b.Build()
+	if err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+
+	composed := b.composeQueryText(q)
+	want := `($color: String = "blue")widget(id: $id, color: $color)`
+	if composed != want {
+		t.Errorf("got composed query: %q, want %q", composed, want)
+	}
+
+	hash := hashQuery(composed)
+	if len(hash) != 64 {
+		t.Errorf("got hash length: %d, want 64 (sha256 hex)", len(hash))
+	}
+	if hash != hashQuery(composed) {
+		t.Errorf("hashQuery is not deterministic for the same input")
+	}
+}
+
+// resolvePersistedQuery is the decision persistedQueryOption calls: the
+// first request for a given hash must send the full query text and record
+// it in the store; a hash the store already knows about sends only the hash
+func TestBuilder_ResolvePersistedQuery(t *testing.T) {
+	store := &fakePersistedQueryStore{}
+
+	first := resolvePersistedQuery(store, "abc", "widget(id: $id)")
+	var r1 requestOptions
+	first(&r1)
+	if r1.persistedQueryText != "widget(id: $id)" {
+		t.Errorf("got first-request text: %q, want full query text", r1.persistedQueryText)
+	}
+	if store.setCalls != 1 {
+		t.Errorf("got Set calls: %d, want 1", store.setCalls)
+	}
+
+	second := resolvePersistedQuery(store, "abc", "widget(id: $id)")
+	var r2 requestOptions
+	second(&r2)
+	if r2.persistedQueryText != "" {
+		t.Errorf("got second-request text: %q, want empty (hash already known)", r2.persistedQueryText)
+	}
+	if store.getCalls != 2 {
+		t.Errorf("got Get calls: %d, want 2", store.getCalls)
+	}
+}
+
+// DecodeResponse used to not exist at all: an aliased query could be
+// composed into a valid document but never decoded back out, since the
+// top-level response key is the alias, not the root field name
+func TestBuilder_DecodeResponse_Alias(t *testing.T) {
+	var a, b struct {
+		ID string `json:"id"`
+	}
+	builder := NewBuilder().
+		BindAlias("a", "user(id: $aID)", &a).
+		BindAlias("b", "user(id: $bID)", &b).
+		Variable("aID", 1).
+		Variable("bID", 2)
+
+	data := map[string]json.RawMessage{
+		"a": json.RawMessage(`{"id":"1"}`),
+		"b": json.RawMessage(`{"id":"2"}`),
+	}
+	if err := builder.DecodeResponse(data); err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if a.ID != "1" || b.ID != "2" {
+		t.Errorf("got a=%+v b=%+v, want a.ID=1 b.ID=2", a, b)
+	}
+}
+
+// without an alias, DecodeResponse falls back to the root field name parsed
+// out of the query string
+func TestBuilder_DecodeResponse_RootFieldName(t *testing.T) {
+	var widget struct {
+		ID string `json:"id"`
+	}
+	builder := NewBuilder().Bind("widget(id: $id)", &widget).Variable("id", 1)
+
+	data := map[string]json.RawMessage{"widget": json.RawMessage(`{"id":"1"}`)}
+	if err := builder.DecodeResponse(data); err != nil {
+		t.Fatalf("got: %v, want no error", err)
+	}
+	if widget.ID != "1" {
+		t.Errorf("got widget.ID: %q, want %q", widget.ID, "1")
+	}
+}
+
+// DecodeResponse used to return a "missing field" error for a BindIf branch
+// the server correctly omitted because its condVar was false
+func TestBuilder_DecodeResponse_BindIfAbsentField(t *testing.T) {
+	var profile struct {
+		ID string `json:"id"`
+	}
+	builder := NewBuilder().
+		BindIf("showDetails", "profile(id: $id)", &profile).
+		Variable("id", 1).
+		Variable("showDetails", false)
+
+	// server omits "profile" entirely since @include(if: $showDetails) was false
+	data := map[string]json.RawMessage{}
+	if err := builder.DecodeResponse(data); err != nil {
+		t.Errorf("got: %v, want no error (absent field tolerated)", err)
+	}
+	if profile.ID != "" {
+		t.Errorf("got profile.ID: %q, want untouched", profile.ID)
+	}
+}
+
+// a non-optional query with a field missing from the response is still a
+// real error, not something DecodeResponse should silently tolerate
+func TestBuilder_DecodeResponse_MissingRequiredField(t *testing.T) {
+	var widget struct {
+		ID string `json:"id"`
+	}
+	builder := NewBuilder().Bind("widget(id: $id)", &widget).Variable("id", 1)
+
+	if err := builder.DecodeResponse(map[string]json.RawMessage{}); err == nil {
+		t.Errorf("got nil error, want missing field error for a non-optional query")
+	}
+}
+
+// a variable count that happens to match the required count, but with a
+// different name, must still fail: Build has to check names, not just counts
+func TestBuilder_Build_MismatchedNameSameCount(t *testing.T) {
+	var widget struct {
+		ID string
+	}
+
+	_, _, err := NewBuilder().
+		Bind("widget(id: $id)", &widget).
+		Variable("typo", 1).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "mismatched variables;") {
+		t.Errorf("got: %v, want mismatched variables error", err)
+	}
+}
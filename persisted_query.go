@@ -0,0 +1,60 @@
+package graphql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// PersistedQueryStore caches the SHA-256 hash of a composed GraphQL
+// operation against its full query text, so repeated requests for the same
+// operation only need to transmit the hash. It backs the Apollo Automatic
+// Persisted Queries (APQ) protocol.
+type PersistedQueryStore interface {
+	Get(hash string) (query string, ok bool)
+	Set(hash string, query string)
+}
+
+// EnablePersistedQueries configures the Client to negotiate the Apollo APQ
+// protocol against store: the happy path sends only
+// extensions.persistedQuery.sha256Hash, and a PersistedQueryNotFound
+// response triggers one retry with the full query text alongside the hash
+// so the server can populate its own cache.
+func EnablePersistedQueries(store PersistedQueryStore) Option {
+	return func(r *requestOptions) {
+		r.persistedQueryStore = store
+	}
+}
+
+// usePersistedQuery marks a single request to send the Apollo APQ hash of
+// the composed operation; query carries the full text to send alongside the
+// hash on the first request for it (or a retry after the server reports
+// PersistedQueryNotFound), and is empty once the hash is already registered
+func usePersistedQuery(hash string, query string) Option {
+	return func(r *requestOptions) {
+		r.persistedQueryHash = hash
+		r.persistedQueryText = query
+	}
+}
+
+// resolvePersistedQuery decides whether hash alone can be sent: store nil or
+// not yet seen this hash sends the full query text alongside it and records
+// it in store, so only the first request for a given operation per store
+// needs to pay for transmitting the text; a hash store already knows about
+// skips straight to hash-only
+func resolvePersistedQuery(store PersistedQueryStore, hash string, query string) Option {
+	if store == nil {
+		return usePersistedQuery(hash, query)
+	}
+	if _, ok := store.Get(hash); ok {
+		return usePersistedQuery(hash, "")
+	}
+	store.Set(hash, query)
+	return usePersistedQuery(hash, query)
+}
+
+// hashQuery returns the SHA-256 hash of the composed operation text, used as
+// the persistedQuery extension value
+func hashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}